@@ -1,10 +1,15 @@
 package store
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
 )
 
 const (
@@ -22,11 +27,32 @@ type metadataType interface {
 	delete(filepath string) error
 }
 
+// pieceStatus is a compressed roaring-bitmap representation of piece state,
+// persisted as a single file. It replaces the old one-byte-per-piece flat
+// file: for torrents with hundreds of thousands of pieces, this cuts disk
+// footprint and lets "which pieces do I still need" be a cheap bitmap diff
+// instead of an O(numPieces) scan.
+//
+// Piece state is tracked with three bitmaps: dirty, done, and dontcare.
+// clean is implicit: a piece present in none of the three bitmaps is clean.
 type pieceStatus struct {
 	index     int
 	numPieces int
 }
 
+// pieceBitmapLocks serializes the read-modify-write-rename cycle in set and
+// setRange per bitmap file, keyed by path. Without this, two pieces of the
+// same torrent completing concurrently -- the normal case for parallel piece
+// downloads -- can race on the shared bitmap file and one update can clobber
+// the other, unlike the old one-byte-per-piece format where concurrent
+// WriteAt calls at disjoint offsets were naturally safe.
+var pieceBitmapLocks sync.Map // map[string]*sync.Mutex
+
+func lockPieceBitmapFile(fp string) *sync.Mutex {
+	v, _ := pieceBitmapLocks.LoadOrStore(fp, &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
+
 func getPieceStatus(index int, numPieces int) metadataType {
 	return &pieceStatus{
 		index:     index,
@@ -34,27 +60,23 @@ func getPieceStatus(index int, numPieces int) metadataType {
 	}
 }
 
-// init initilizes pieceStatue of all pieces as clean
+func (p *pieceStatus) path(filepath string) string {
+	return filepath + "_status"
+}
+
+// init initializes the bitmap file if it does not already exist, with every
+// piece starting out clean (i.e. absent from all three bitmaps).
 func (p *pieceStatus) init(filepath string) error {
 	fp := p.path(filepath)
 	if _, err := os.Stat(fp); !os.IsNotExist(err) {
 		return nil
 	}
-
-	data := make([]byte, p.numPieces)
-	for i := 0; i < p.numPieces; i++ {
-		data[i] = pieceClean
-	}
-
-	return ioutil.WriteFile(fp, data, 0755)
+	return writePieceBitmaps(fp, roaring.New(), roaring.New(), roaring.New())
 }
 
-func (p *pieceStatus) path(filepath string) string {
-	return filepath + "_status"
-}
-
-// set updates piece status and returns true only if the file is updated correctly
-// returns false if error or file is already updated with desired content
+// set updates the status of the single piece at p.index and returns true
+// only if the bitmap file was updated. Returns false if the piece already
+// has the desired status.
 func (p *pieceStatus) set(filepath string, content []byte) (bool, error) {
 	fp := p.path(filepath)
 	if err := p.init(filepath); err != nil {
@@ -65,58 +87,90 @@ func (p *pieceStatus) set(filepath string, content []byte) (bool, error) {
 		return false, fmt.Errorf("Invalid content: %v", content)
 	}
 
-	data, err := ioutil.ReadFile(fp)
+	if p.index < 0 || p.index >= p.numPieces {
+		return false, fmt.Errorf("Index out of range for %s: %d", fp, p.index)
+	}
+
+	lock := lockPieceBitmapFile(fp)
+	lock.Lock()
+	defer lock.Unlock()
+
+	dirty, done, dontcare, err := readPieceBitmaps(fp)
 	if err != nil {
 		return false, err
 	}
 
-	if p.index < 0 || p.index >= len(data) {
-		return false, fmt.Errorf("Index out of range for %s: %d", fp, p.index)
+	if pieceStateOf(dirty, done, dontcare, p.index) == content[0] {
+		return false, nil
 	}
 
-	if data[p.index] == content[0] {
-		return false, nil
+	applyPieceState(dirty, done, dontcare, p.index, content[0])
+
+	if err := writePieceBitmaps(fp, dirty, done, dontcare); err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
-	f, err := os.OpenFile(fp, os.O_RDWR, 0755)
-	if err != nil {
+// setRange atomically transitions every piece in [from, to) to state in a
+// single bitmap update, avoiding one syscall per piece when callers need to
+// mutate many piece states at once (e.g. after a webseed or endgame batch
+// completes, or when seeding a torrent that starts out fully done).
+func (p *pieceStatus) setRange(filepath string, from, to int, state uint8) (bool, error) {
+	if err := p.init(filepath); err != nil {
 		return false, err
 	}
-	defer f.Close()
+	if from < 0 || to > p.numPieces || from > to {
+		return false, fmt.Errorf("Range out of bounds for %s: [%d, %d)", filepath, from, to)
+	}
+
+	fp := p.path(filepath)
+
+	lock := lockPieceBitmapFile(fp)
+	lock.Lock()
+	defer lock.Unlock()
 
-	_, err = f.WriteAt(content, int64(p.index))
+	dirty, done, dontcare, err := readPieceBitmaps(fp)
 	if err != nil {
 		return false, err
 	}
+
+	changed := false
+	for i := from; i < to; i++ {
+		if pieceStateOf(dirty, done, dontcare, i) == state {
+			continue
+		}
+		applyPieceState(dirty, done, dontcare, i, state)
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	if err := writePieceBitmaps(fp, dirty, done, dontcare); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
 func (p *pieceStatus) get(filepath string) ([]byte, error) {
 	fp := p.path(filepath)
 
-	// check existence
-	if _, err := os.Stat(fp); err != nil {
-		return nil, err
-	}
+	lock := lockPieceBitmapFile(fp)
+	lock.Lock()
+	defer lock.Unlock()
 
-	// read to data
-	f, err := os.Open(fp)
+	dirty, done, dontcare, err := readPieceBitmaps(fp)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	content := make([]byte, 1)
-
-	_, err = f.ReadAt(content, int64(p.index))
-	if err != nil {
-		return nil, err
+	if p.index < 0 || p.index >= p.numPieces {
+		return nil, fmt.Errorf("Index out of range for %s: %d", fp, p.index)
 	}
 
-	return content, nil
+	return []byte{pieceStateOf(dirty, done, dontcare, p.index)}, nil
 }
 
-// delete deletes pieceStatue of the filepath, i.e. deletes all statuses
+// delete deletes the bitmap file for filepath, i.e. deletes all statuses.
 func (p *pieceStatus) delete(filepath string) error {
 	fp := p.path(filepath)
 
@@ -127,6 +181,115 @@ func (p *pieceStatus) delete(filepath string) error {
 	return nil
 }
 
+// pieceStateOf derives the single-byte state of piece i from the
+// dirty/done/dontcare bitmaps, defaulting to pieceClean when it appears in
+// none of them.
+func pieceStateOf(dirty, done, dontcare *roaring.Bitmap, i int) uint8 {
+	switch {
+	case done.ContainsInt(i):
+		return pieceDone
+	case dirty.ContainsInt(i):
+		return pieceDirty
+	case dontcare.ContainsInt(i):
+		return pieceDontCare
+	default:
+		return pieceClean
+	}
+}
+
+// applyPieceState moves piece i into the bitmap corresponding to state,
+// removing it from the others so the bitmaps stay mutually exclusive.
+func applyPieceState(dirty, done, dontcare *roaring.Bitmap, i int, state uint8) {
+	dirty.Remove(uint32(i))
+	done.Remove(uint32(i))
+	dontcare.Remove(uint32(i))
+	switch state {
+	case pieceDirty:
+		dirty.AddInt(i)
+	case pieceDone:
+		done.AddInt(i)
+	case pieceDontCare:
+		dontcare.AddInt(i)
+	}
+}
+
+// writePieceBitmaps writes the on-disk layout of the three bitmaps (dirty,
+// done, dontcare, in that order): each is length-prefixed so they can be
+// read back independently.
+func writePieceBitmaps(fp string, dirty, done, dontcare *roaring.Bitmap) error {
+	var buf bytes.Buffer
+	for _, bm := range []*roaring.Bitmap{dirty, done, dontcare} {
+		b, err := bm.ToBytes()
+		if err != nil {
+			return fmt.Errorf("serialize bitmap: %s", err)
+		}
+		if err := writeUint32(&buf, uint32(len(b))); err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+
+	// Write to a temp file and rename into place so readers never observe a
+	// partially-written bitmap file.
+	tmp := fp + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+func readPieceBitmaps(fp string) (dirty, done, dontcare *roaring.Bitmap, err error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r := bytes.NewReader(data)
+
+	dirty, err = readBitmap(r)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("read dirty bitmap: %s", err)
+	}
+	done, err = readBitmap(r)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("read done bitmap: %s", err)
+	}
+	dontcare, err = readBitmap(r)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("read dontcare bitmap: %s", err)
+	}
+	return dirty, done, dontcare, nil
+}
+
+func readBitmap(r *bytes.Reader) (*roaring.Bitmap, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	bm := roaring.New()
+	if _, err := bm.FromBuffer(b); err != nil {
+		return nil, fmt.Errorf("deserialize bitmap: %s", err)
+	}
+	return bm, nil
+}
+
+func writeUint32(buf *bytes.Buffer, v uint32) error {
+	b := []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	_, err := buf.Write(b)
+	return err
+}
+
+func readUint32(r *bytes.Reader) (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), nil
+}
+
 type startedAt struct {
 }
 
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPieceStatusSetGetRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "piecestatus_test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fp := dir + "/test_file"
+	numPieces := 10
+
+	for i, state := range []uint8{pieceDirty, pieceDone, pieceDontCare} {
+		p := getPieceStatus(i, numPieces)
+
+		updated, err := p.set(fp, []byte{state})
+		require.NoError(err)
+		require.True(updated)
+
+		got, err := p.get(fp)
+		require.NoError(err)
+		require.Equal([]byte{state}, got)
+
+		// Setting the same state again should be a no-op.
+		updated, err = p.set(fp, []byte{state})
+		require.NoError(err)
+		require.False(updated)
+	}
+
+	// A piece never touched defaults to clean.
+	clean := getPieceStatus(numPieces-1, numPieces)
+	got, err := clean.get(fp)
+	require.NoError(err)
+	require.Equal([]byte{pieceClean}, got)
+}
+
+func TestPieceStatusSetRange(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "piecestatus_test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	fp := dir + "/test_file"
+	numPieces := 5
+
+	p := getPieceStatus(0, numPieces)
+	updated, err := p.setRange(fp, 0, numPieces, pieceDone)
+	require.NoError(err)
+	require.True(updated)
+
+	for i := 0; i < numPieces; i++ {
+		got, err := getPieceStatus(i, numPieces).get(fp)
+		require.NoError(err)
+		require.Equal([]byte{pieceDone}, got)
+	}
+
+	// Re-applying the same range is a no-op.
+	updated, err = p.setRange(fp, 0, numPieces, pieceDone)
+	require.NoError(err)
+	require.False(updated)
+}
+
+func TestReadBitmapErrorsOnTruncatedData(t *testing.T) {
+	require := require.New(t)
+
+	// Length prefix claims 10 bytes follow, but only 3 are actually present.
+	var buf bytes.Buffer
+	require.NoError(writeUint32(&buf, 10))
+	buf.Write([]byte{0x01, 0x02, 0x03})
+
+	_, err := readBitmap(bytes.NewReader(buf.Bytes()))
+	require.Error(err)
+}
+
+func TestReadUint32ErrorsOnTruncatedData(t *testing.T) {
+	require := require.New(t)
+
+	_, err := readUint32(bytes.NewReader([]byte{0x00, 0x01}))
+	require.Error(err)
+}
+
+func TestPieceStatusSetInvalidContent(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "piecestatus_test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	p := getPieceStatus(0, 1)
+	_, err = p.set(dir+"/test_file", []byte{pieceDone, pieceDone})
+	require.Error(err)
+}
@@ -0,0 +1,509 @@
+package scheduler
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"code.uber.internal/infra/kraken/lib/torrent/scheduler/conn"
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// errTorrentAtCapacity is returned when a torrent has no room for any more
+// conns in either direction.
+var errTorrentAtCapacity = errors.New("torrent is at capacity")
+
+// errIncomingQuotaReached is returned when a torrent's incoming conns have
+// filled the portion of its cap reserved for the incoming direction, even
+// though the torrent's overall cap has not been reached.
+var errIncomingQuotaReached = errors.New("torrent's incoming conn quota is reached")
+
+// errOutgoingQuotaReached is the outgoing-direction counterpart of
+// errIncomingQuotaReached.
+var errOutgoingQuotaReached = errors.New("torrent's outgoing conn quota is reached")
+
+// errAlreadyPending is returned when a peer/hash pair is already mid-handshake.
+var errAlreadyPending = errors.New("conn is already pending")
+
+// errAlreadyActive is returned when a peer/hash pair already has an active conn.
+var errAlreadyActive = errors.New("conn is already active")
+
+// errPeerBlacklisted is returned when a peer/hash pair is currently blacklisted.
+var errPeerBlacklisted = errors.New("peer is blacklisted")
+
+// connStateConfig configures connState's capacity and blacklist behavior.
+type connStateConfig struct {
+	MaxOpenConnectionsPerTorrent int
+	// IncomingConnFraction is the fraction of MaxOpenConnectionsPerTorrent
+	// reserved for incoming conns. Defaults to 0.5 so neither direction can
+	// starve the other of capacity.
+	IncomingConnFraction      float64
+	BlacklistDuration         time.Duration
+	BlacklistExtendedDuration time.Duration
+}
+
+func (c connStateConfig) applyDefaults() connStateConfig {
+	if c.IncomingConnFraction == 0 {
+		c.IncomingConnFraction = 0.5
+	}
+	if c.BlacklistDuration == 0 {
+		c.BlacklistDuration = 10 * time.Minute
+	}
+	if c.BlacklistExtendedDuration == 0 {
+		c.BlacklistExtendedDuration = 24 * time.Hour
+	}
+	return c
+}
+
+type connKey struct {
+	peerID   torlib.PeerID
+	infoHash torlib.InfoHash
+}
+
+// torrentConnCounts tracks, per torrent, how many conns (pending or active)
+// are currently open in each direction.
+type torrentConnCounts struct {
+	incoming int
+	outgoing int
+}
+
+func (c *torrentConnCounts) total() int {
+	return c.incoming + c.outgoing
+}
+
+// BlacklistedConn describes a blacklisted peer/hash pair and when its
+// blacklist entry expires, for reporting via blacklistSnapshotEvent.
+type BlacklistedConn struct {
+	PeerID    torlib.PeerID
+	InfoHash  torlib.InfoHash
+	ExpiresAt time.Time
+}
+
+// connState tracks every pending and active conn the Scheduler knows about,
+// enforces per-torrent capacity (including the incoming/outgoing quota
+// split), and maintains the blacklist of peers that misbehaved. All access
+// is synchronized since handshakes complete on their own goroutines and
+// report back into the single-threaded event loop asynchronously.
+type connState struct {
+	mu sync.Mutex
+
+	config connStateConfig
+
+	pendingDir map[connKey]bool // true = incoming, false = outgoing
+	active     map[connKey]*conn.Conn
+	activeDir  map[connKey]bool
+
+	counts map[torlib.InfoHash]*torrentConnCounts
+
+	blacklist map[connKey]time.Time
+
+	// natRelay maps a peer/hash pair that announced a NAT address to the
+	// peer id of an active conn in the same swarm that can relay a
+	// holepunch rendezvous on its behalf.
+	natRelay map[connKey]torlib.PeerID
+
+	// remembered caches the address of every peer seen in an announce
+	// response, so that a later conn-balance pass can dial them again
+	// without waiting for the next scheduled announce.
+	remembered map[torlib.InfoHash]map[torlib.PeerID]string
+
+	// webseedConns tracks in-flight/recently-active webseed fetches, keyed
+	// by URL and torrent, so that preemptionTickEvent can sweep them with
+	// the same idle/TTL bookkeeping it applies to peer conns instead of
+	// them being invisible to it.
+	webseedConns map[webseedConnKey]*webseedConn
+}
+
+// webseedConnKey keys a tracked webseedConn by the URL it fetches from and
+// the torrent it's fetching for -- the closest analog this package has to a
+// peer/hash pair for a "conn" that isn't a real conn.Conn.
+type webseedConnKey struct {
+	url      string
+	infoHash torlib.InfoHash
+}
+
+func newConnState(config connStateConfig) *connState {
+	return &connState{
+		config:       config.applyDefaults(),
+		pendingDir:   make(map[connKey]bool),
+		active:       make(map[connKey]*conn.Conn),
+		activeDir:    make(map[connKey]bool),
+		counts:       make(map[torlib.InfoHash]*torrentConnCounts),
+		blacklist:    make(map[connKey]time.Time),
+		natRelay:     make(map[connKey]torlib.PeerID),
+		remembered:   make(map[torlib.InfoHash]map[torlib.PeerID]string),
+		webseedConns: make(map[webseedConnKey]*webseedConn),
+	}
+}
+
+func (s *connState) countsFor(infoHash torlib.InfoHash) *torrentConnCounts {
+	c, ok := s.counts[infoHash]
+	if !ok {
+		c = &torrentConnCounts{}
+		s.counts[infoHash] = c
+	}
+	return c
+}
+
+// AddPendingIncoming reserves a slot for an incoming peer/hash pair, failing
+// if the peer is blacklisted, already pending/active, the torrent is at its
+// overall cap, or the torrent's incoming quota (MaxOpenConnectionsPerTorrent
+// * IncomingConnFraction) is already full.
+func (s *connState) AddPendingIncoming(peerID torlib.PeerID, infoHash torlib.InfoHash) error {
+	return s.addPending(peerID, infoHash, true)
+}
+
+// AddPendingOutgoing is the outgoing-direction counterpart of
+// AddPendingIncoming.
+func (s *connState) AddPendingOutgoing(peerID torlib.PeerID, infoHash torlib.InfoHash) error {
+	return s.addPending(peerID, infoHash, false)
+}
+
+func (s *connState) addPending(peerID torlib.PeerID, infoHash torlib.InfoHash, incoming bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{peerID, infoHash}
+
+	if expiresAt, ok := s.blacklist[key]; ok && time.Now().Before(expiresAt) {
+		return errPeerBlacklisted
+	}
+	if _, ok := s.pendingDir[key]; ok {
+		return errAlreadyPending
+	}
+	if _, ok := s.active[key]; ok {
+		return errAlreadyActive
+	}
+
+	counts := s.countsFor(infoHash)
+	if counts.total() >= s.config.MaxOpenConnectionsPerTorrent {
+		return errTorrentAtCapacity
+	}
+	reserved := int(math.Ceil(
+		float64(s.config.MaxOpenConnectionsPerTorrent) * s.config.IncomingConnFraction))
+	if incoming && counts.incoming >= reserved {
+		return errIncomingQuotaReached
+	}
+	if !incoming && counts.outgoing >= s.config.MaxOpenConnectionsPerTorrent-reserved {
+		return errOutgoingQuotaReached
+	}
+
+	s.pendingDir[key] = incoming
+	if incoming {
+		counts.incoming++
+	} else {
+		counts.outgoing++
+	}
+	return nil
+}
+
+// DeletePending removes a pending peer/hash pair, e.g. after its handshake
+// fails, releasing the capacity it reserved.
+func (s *connState) DeletePending(peerID torlib.PeerID, infoHash torlib.InfoHash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{peerID, infoHash}
+	incoming, ok := s.pendingDir[key]
+	if !ok {
+		return
+	}
+	delete(s.pendingDir, key)
+	counts := s.countsFor(infoHash)
+	if incoming {
+		counts.incoming--
+	} else {
+		counts.outgoing--
+	}
+}
+
+// PromoteActive transitions a pending peer/hash pair into an active conn,
+// keeping it counted against its original direction's quota for as long as
+// the conn stays open.
+func (s *connState) PromoteActive(c *conn.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.PeerID(), c.InfoHash()}
+	incoming, ok := s.pendingDir[key]
+	if !ok {
+		// Conn was promoted without going through AddPending*; default to
+		// outgoing so it is still accounted for somewhere.
+		incoming = false
+		s.countsFor(c.InfoHash()).outgoing++
+	}
+	delete(s.pendingDir, key)
+	s.active[key] = c
+	s.activeDir[key] = incoming
+}
+
+// DeleteActive ejects an active conn, releasing the capacity it held.
+func (s *connState) DeleteActive(c *conn.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.PeerID(), c.InfoHash()}
+	if _, ok := s.active[key]; !ok {
+		return
+	}
+	incoming := s.activeDir[key]
+	delete(s.active, key)
+	delete(s.activeDir, key)
+
+	counts := s.countsFor(c.InfoHash())
+	if incoming {
+		counts.incoming--
+	} else {
+		counts.outgoing--
+	}
+}
+
+// ActiveConns returns every currently active conn across all torrents.
+func (s *connState) ActiveConns() []*conn.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*conn.Conn, 0, len(s.active))
+	for _, c := range s.active {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// ActiveConnsForTorrent returns every currently active conn for infoHash,
+// e.g. to find a candidate relay for a holepunch rendezvous within the same
+// swarm.
+func (s *connState) ActiveConnsForTorrent(infoHash torlib.InfoHash) []*conn.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conns []*conn.Conn
+	for key, c := range s.active {
+		if key.infoHash == infoHash {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// ActiveConn returns the active conn for peerID/infoHash, if any.
+func (s *connState) ActiveConn(peerID torlib.PeerID, infoHash torlib.InfoHash) (*conn.Conn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.active[connKey{peerID, infoHash}]
+	return c, ok
+}
+
+// NumActiveConns returns the total number of active conns across all torrents.
+func (s *connState) NumActiveConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.active)
+}
+
+// NumIncomingConns returns the number of incoming conns (pending or active)
+// across all torrents.
+func (s *connState) NumIncomingConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, c := range s.counts {
+		n += c.incoming
+	}
+	return n
+}
+
+// NumOutgoingConns is the outgoing-direction counterpart of NumIncomingConns.
+func (s *connState) NumOutgoingConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, c := range s.counts {
+		n += c.outgoing
+	}
+	return n
+}
+
+// IncomingSaturatedTorrents returns the set of torrents whose incoming conns
+// have filled their reserved quota while the overall cap still has room --
+// the exact condition under which connBalanceTickEvent should dial out to
+// remembered peers instead of waiting on incoming conns to arrive.
+func (s *connState) IncomingSaturatedTorrents() map[torlib.InfoHash]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reserved := int(math.Ceil(
+		float64(s.config.MaxOpenConnectionsPerTorrent) * s.config.IncomingConnFraction))
+
+	saturated := make(map[torlib.InfoHash]bool)
+	for infoHash, c := range s.counts {
+		if c.incoming >= reserved && c.total() < s.config.MaxOpenConnectionsPerTorrent {
+			saturated[infoHash] = true
+		}
+	}
+	return saturated
+}
+
+// RememberPeer caches addr as the dial address for peerID within infoHash,
+// typically called as announce responses for infoHash arrive.
+func (s *connState) RememberPeer(peerID torlib.PeerID, infoHash torlib.InfoHash, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers, ok := s.remembered[infoHash]
+	if !ok {
+		peers = make(map[torlib.PeerID]string)
+		s.remembered[infoHash] = peers
+	}
+	peers[peerID] = addr
+}
+
+// RememberedPeers returns every peer id remembered for infoHash from past
+// announce responses.
+func (s *connState) RememberedPeers(infoHash torlib.InfoHash) []torlib.PeerID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers := s.remembered[infoHash]
+	pids := make([]torlib.PeerID, 0, len(peers))
+	for pid := range peers {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// RememberedAddr returns the last known dial address for peerID/infoHash.
+func (s *connState) RememberedAddr(peerID torlib.PeerID, infoHash torlib.InfoHash) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers, ok := s.remembered[infoHash]
+	if !ok {
+		return "", false
+	}
+	addr, ok := peers[peerID]
+	return addr, ok
+}
+
+// SetNATRelay records that relay can be asked to broker a holepunch
+// rendezvous with target within infoHash.
+func (s *connState) SetNATRelay(target torlib.PeerID, infoHash torlib.InfoHash, relay torlib.PeerID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.natRelay[connKey{target, infoHash}] = relay
+}
+
+// NATRelay returns the relay peer id for target/infoHash, if one was
+// recorded via SetNATRelay.
+func (s *connState) NATRelay(target torlib.PeerID, infoHash torlib.InfoHash) (torlib.PeerID, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	relay, ok := s.natRelay[connKey{target, infoHash}]
+	return relay, ok
+}
+
+// EnsureWebseedConn returns the tracked webseedConn for url/infoHash,
+// registering a new one starting at now if one isn't already tracked. It is
+// idempotent across repeated ticks against the same URL so that an
+// in-progress fetch's createdAt isn't reset each time, which would defeat
+// preemptionTickEvent's TTL sweep.
+func (s *connState) EnsureWebseedConn(url string, infoHash torlib.InfoHash, now time.Time) *webseedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := webseedConnKey{url, infoHash}
+	c, ok := s.webseedConns[key]
+	if !ok {
+		c = newWebseedConn(url, infoHash, now)
+		s.webseedConns[key] = c
+	}
+	return c
+}
+
+// TouchWebseedConn refreshes url/infoHash's last-active time, e.g. after a
+// successful fetch, so an actively-used webseed URL isn't preempted as idle.
+func (s *connState) TouchWebseedConn(url string, infoHash torlib.InfoHash, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.webseedConns[webseedConnKey{url, infoHash}]; ok {
+		c.lastActive = now
+	}
+}
+
+// DeleteWebseedConn forgets url/infoHash's webseed conn, e.g. once
+// preemptionTickEvent decides it has gone idle or expired.
+func (s *connState) DeleteWebseedConn(url string, infoHash torlib.InfoHash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.webseedConns, webseedConnKey{url, infoHash})
+}
+
+// WebseedConns returns every currently tracked webseed conn.
+func (s *connState) WebseedConns() []*webseedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*webseedConn, 0, len(s.webseedConns))
+	for _, c := range s.webseedConns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Blacklist blacklists peerID/infoHash for config.BlacklistDuration.
+func (s *connState) Blacklist(peerID torlib.PeerID, infoHash torlib.InfoHash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blacklist[connKey{peerID, infoHash}] = time.Now().Add(s.config.BlacklistDuration)
+	return nil
+}
+
+// BlacklistExtended blacklists peerID/infoHash for the longer
+// config.BlacklistExtendedDuration, for use against peers smart-banned for
+// contributing to a piece hash check failure.
+func (s *connState) BlacklistExtended(peerID torlib.PeerID, infoHash torlib.InfoHash) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blacklist[connKey{peerID, infoHash}] = time.Now().Add(s.config.BlacklistExtendedDuration)
+	return nil
+}
+
+// DeleteStaleBlacklistEntries removes every blacklist entry that has expired.
+func (s *connState) DeleteStaleBlacklistEntries() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, expiresAt := range s.blacklist {
+		if now.After(expiresAt) {
+			delete(s.blacklist, key)
+		}
+	}
+}
+
+// BlacklistSnapshot returns every currently blacklisted peer/hash pair.
+func (s *connState) BlacklistSnapshot() []BlacklistedConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make([]BlacklistedConn, 0, len(s.blacklist))
+	for key, expiresAt := range s.blacklist {
+		snapshot = append(snapshot, BlacklistedConn{
+			PeerID:    key.peerID,
+			InfoHash:  key.infoHash,
+			ExpiresAt: expiresAt,
+		})
+	}
+	return snapshot
+}
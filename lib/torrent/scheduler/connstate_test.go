@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+func newTestConnState(maxConns int, incomingFraction float64) *connState {
+	return newConnState(connStateConfig{
+		MaxOpenConnectionsPerTorrent: maxConns,
+		IncomingConnFraction:         incomingFraction,
+	})
+}
+
+func TestAddPendingIncomingQuotaReached(t *testing.T) {
+	require := require.New(t)
+
+	// Cap of 4, 50% reserved for incoming -- 2 incoming slots.
+	s := newTestConnState(4, 0.5)
+	infoHash := torlib.InfoHash{}
+
+	require.NoError(s.AddPendingIncoming(torlib.PeerID{0}, infoHash))
+	require.NoError(s.AddPendingIncoming(torlib.PeerID{1}, infoHash))
+
+	// A third incoming conn exceeds the reserved incoming quota, even
+	// though the torrent's overall cap (4) still has room.
+	err := s.AddPendingIncoming(torlib.PeerID{2}, infoHash)
+	require.Equal(errIncomingQuotaReached, err)
+}
+
+func TestAddPendingOutgoingQuotaReached(t *testing.T) {
+	require := require.New(t)
+
+	s := newTestConnState(4, 0.5)
+	infoHash := torlib.InfoHash{}
+
+	require.NoError(s.AddPendingOutgoing(torlib.PeerID{0}, infoHash))
+	require.NoError(s.AddPendingOutgoing(torlib.PeerID{1}, infoHash))
+
+	err := s.AddPendingOutgoing(torlib.PeerID{2}, infoHash)
+	require.Equal(errOutgoingQuotaReached, err)
+}
+
+func TestAddPendingTorrentAtCapacity(t *testing.T) {
+	require := require.New(t)
+
+	// Cap of 2, 50% reserved for incoming -- 1 incoming and 1 outgoing
+	// slot. With both filled, the overall cap is checked before the
+	// incoming quota, so a further incoming conn gets errTorrentAtCapacity.
+	s := newTestConnState(2, 0.5)
+	infoHash := torlib.InfoHash{}
+
+	require.NoError(s.AddPendingIncoming(torlib.PeerID{0}, infoHash))
+	require.NoError(s.AddPendingOutgoing(torlib.PeerID{1}, infoHash))
+
+	err := s.AddPendingIncoming(torlib.PeerID{2}, infoHash)
+	require.Equal(errTorrentAtCapacity, err)
+}
+
+func TestAddPendingReleasesQuotaOnDelete(t *testing.T) {
+	require := require.New(t)
+
+	s := newTestConnState(4, 0.5)
+	infoHash := torlib.InfoHash{}
+	peerID := torlib.PeerID{0}
+
+	require.NoError(s.AddPendingIncoming(peerID, infoHash))
+	require.NoError(s.AddPendingIncoming(torlib.PeerID{1}, infoHash))
+	require.Equal(errIncomingQuotaReached, s.AddPendingIncoming(torlib.PeerID{2}, infoHash))
+
+	s.DeletePending(peerID, infoHash)
+
+	// Deleting the first pending conn frees its reserved slot.
+	require.NoError(s.AddPendingIncoming(torlib.PeerID{2}, infoHash))
+}
+
+func TestAddPendingRejectsDuplicatesAndBlacklisted(t *testing.T) {
+	require := require.New(t)
+
+	s := newTestConnState(4, 0.5)
+	infoHash := torlib.InfoHash{}
+	peerID := torlib.PeerID{0}
+
+	require.NoError(s.AddPendingIncoming(peerID, infoHash))
+	require.Equal(errAlreadyPending, s.AddPendingIncoming(peerID, infoHash))
+
+	s.DeletePending(peerID, infoHash)
+	require.NoError(s.Blacklist(peerID, infoHash))
+	require.Equal(errPeerBlacklisted, s.AddPendingIncoming(peerID, infoHash))
+}
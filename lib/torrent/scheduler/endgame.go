@@ -0,0 +1,95 @@
+package scheduler
+
+import (
+	"code.uber.internal/infra/kraken/lib/torrent/scheduler/conn"
+)
+
+// endgameMissingFloor is the absolute minimum number of missing pieces at or
+// below which a torrent enters endgame, regardless of its size.
+const endgameMissingFloor = 5
+
+// endgameMissingFraction is the fraction of total pieces still missing at or
+// below which a torrent enters endgame, for torrents large enough that the
+// absolute floor would trigger too late.
+const endgameMissingFraction = 0.05
+
+// endgameMaxDuplicates is the number of peers a single missing block may be
+// requested from in parallel during endgame.
+const endgameMaxDuplicates = 3
+
+// endgameThreshold returns the number of missing pieces at or below which
+// numPieces total pieces should be considered to be in endgame.
+func endgameThreshold(numPieces int) int {
+	t := int(float64(numPieces) * endgameMissingFraction)
+	if t < endgameMissingFloor {
+		t = endgameMissingFloor
+	}
+	return t
+}
+
+// endgameTickEvent occurs periodically to drive endgame mode: once a torrent
+// has few enough pieces remaining, the same missing blocks are requested
+// from multiple peers in parallel so that one slow peer can no longer hold
+// up completion of the whole torrent.
+type endgameTickEvent struct{}
+
+// Apply inspects each dispatcher in s.torrentControls and, for any dispatcher
+// whose missing piece count has dropped at or below its endgame threshold,
+// issues duplicate requests for its remaining blocks to up to
+// endgameMaxDuplicates peers which have announced the piece.
+func (e endgameTickEvent) Apply(s *Scheduler) {
+	s.log().Debug("Applying endgame tick event")
+
+	for infoHash, ctrl := range s.torrentControls {
+		if ctrl.Complete {
+			continue
+		}
+		d := ctrl.Dispatcher
+		numPieces := d.Torrent.NumPieces()
+		missing := d.Torrent.MissingPieces()
+		if len(missing) > endgameThreshold(numPieces) {
+			ctrl.Endgame = false
+			continue
+		}
+		if !ctrl.Endgame {
+			s.log("hash", infoHash, "missing", len(missing)).Info("Entering endgame")
+			ctrl.Endgame = true
+		}
+		for _, pieceIndex := range missing {
+			candidates := d.PeersWithPiece(pieceIndex)
+			if len(candidates) == 0 {
+				continue
+			}
+			// Route the duplicate-peer selection through the torrent's
+			// RequestStrategy rather than picking arbitrarily, so e.g. a
+			// fastest-first torrent still prefers its fastest conns even
+			// while in endgame.
+			candidates = ctrl.Strategy.ChoosePeersForPiece(infoHash, pieceIndex, candidates)
+			if len(candidates) > endgameMaxDuplicates {
+				candidates = candidates[:endgameMaxDuplicates]
+			}
+			d.RequestDuplicates(pieceIndex, candidates)
+		}
+	}
+}
+
+// endgamePieceReceivedEvent occurs when a block requested during endgame
+// arrives from one of the peers it was duplicated to. It tells the
+// dispatcher to cancel the outstanding duplicate requests for the same
+// block against every other peer it was sent to.
+type endgamePieceReceivedEvent struct {
+	pieceIndex  int
+	blockOffset int64
+	from        *conn.Conn
+}
+
+// Apply cancels the duplicate in-flight requests for the block that just
+// arrived, so peers that lost the race stop sending (or are told to stop
+// sending) bytes that are no longer needed.
+func (e endgamePieceReceivedEvent) Apply(s *Scheduler) {
+	ctrl, ok := s.torrentControls[e.from.InfoHash()]
+	if !ok {
+		return
+	}
+	ctrl.Dispatcher.CancelDuplicates(e.pieceIndex, e.blockOffset, e.from)
+}
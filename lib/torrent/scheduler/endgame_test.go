@@ -0,0 +1,22 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndgameThresholdUsesFloorForSmallTorrents(t *testing.T) {
+	require := require.New(t)
+
+	// 5% of 20 is 1, which is below endgameMissingFloor, so the floor wins.
+	require.Equal(endgameMissingFloor, endgameThreshold(20))
+	require.Equal(endgameMissingFloor, endgameThreshold(0))
+}
+
+func TestEndgameThresholdUsesFractionForLargeTorrents(t *testing.T) {
+	require := require.New(t)
+
+	// 5% of 10000 is 500, comfortably above the floor.
+	require.Equal(500, endgameThreshold(10000))
+}
@@ -84,6 +84,10 @@ func (e closedConnEvent) Apply(s *Scheduler) {
 	}
 }
 
+// pieceHashFailedEvent is defined in smartban.go. It blacklists the peers
+// whose recorded block CRCs are responsible for a piece failing its SHA
+// check, complementing the blanket transport-failure blacklisting below.
+
 // failedHandshakeEvent occurs when a pending connection fails to handshake.
 type failedHandshakeEvent struct {
 	peerID   torlib.PeerID
@@ -96,6 +100,16 @@ func (e failedHandshakeEvent) Apply(s *Scheduler) {
 	s.log("peer", e.peerID, "hash", e.infoHash).Debug("Applying failed handshake event")
 
 	s.connState.DeletePending(e.peerID, e.infoHash)
+
+	if relay, ok := s.connState.NATRelay(e.peerID, e.infoHash); ok {
+		// The peer announced behind a NAT address we couldn't dial
+		// directly. Rather than blacklisting it outright, ask a
+		// tracker-connected relay to broker a simultaneous dial.
+		// See holepunch.go.
+		s.eventLoop.Send(holepunchRendezvousEvent{e.infoHash, e.peerID, relay})
+		return
+	}
+
 	if err := s.connState.Blacklist(e.peerID, e.infoHash); err != nil {
 		s.log("peer", e.peerID, "hash", e.infoHash).Infof(
 			"Error blacklisting pending conn: %s", err)
@@ -107,12 +121,17 @@ type incomingHandshakeEvent struct {
 	pc *conn.PendingConn
 }
 
-// Apply rejects incoming handshakes when the Scheduler is at capacity. If the
-// Scheduler has capacity for more connections, adds the peer/hash of the handshake
-// to the Scheduler's pending connections and asynchronously attempts to establish
-// the connection.
+// Apply rejects incoming handshakes when the Scheduler is at capacity, or
+// when the torrent's reserved incoming quota (s.config.IncomingConnFraction
+// of its overall cap) is already full -- even if the overall cap itself has
+// room. This keeps a single direction of conns from crowding out the other,
+// e.g. a seeder accepting 100% incoming conns and never dialing out for
+// fresh peers from announce. If the Scheduler has capacity for more
+// connections, adds the peer/hash of the handshake to the Scheduler's
+// pending connections and asynchronously attempts to establish the
+// connection.
 func (e incomingHandshakeEvent) Apply(s *Scheduler) {
-	if err := s.connState.AddPending(e.pc.PeerID(), e.pc.InfoHash()); err != nil {
+	if err := s.connState.AddPendingIncoming(e.pc.PeerID(), e.pc.InfoHash()); err != nil {
 		s.log("peer", e.pc.PeerID(), "hash", e.pc.InfoHash()).Infof(
 			"Rejecting incoming handshake: %s", err)
 		e.pc.Close()
@@ -124,6 +143,9 @@ func (e incomingHandshakeEvent) Apply(s *Scheduler) {
 			e.pc.Close()
 			return
 		}
+		// Establish sniffs the first bytes of e.pc to decide whether the
+		// dialer is speaking plaintext Kraken or MSE/PE, per
+		// s.config.ConnEncryption. See mse.go.
 		c, err := s.handshaker.Establish(e.pc, info)
 		if err != nil {
 			s.log("peer", e.pc.PeerID(), "hash", e.pc.InfoHash()).Infof(
@@ -144,6 +166,8 @@ type incomingConnEvent struct {
 }
 
 // Apply transitions a fully-handshaked incoming conn from pending to active.
+// Piece assignment for the new conn is delegated to the torrentControl's
+// RequestStrategy (see requeststrategy.go) rather than decided here.
 func (e incomingConnEvent) Apply(s *Scheduler) {
 	s.log("conn", e.c, "torrent", e.info).Debug("Applying incoming conn event")
 
@@ -153,6 +177,11 @@ func (e incomingConnEvent) Apply(s *Scheduler) {
 		return
 	}
 	s.log("conn", e.c, "bitfield", e.bitfield).Info("Added incoming conn")
+
+	if ctrl, ok := s.torrentControls[e.c.InfoHash()]; ok {
+		ctrl.Strategy.RecordBitfield(e.c.InfoHash(), e.bitfield)
+		s.assignPieces(ctrl, e.c)
+	}
 }
 
 // outgoingConnEvent occurs when a pending outgoing connection finishes handshaking.
@@ -163,6 +192,8 @@ type outgoingConnEvent struct {
 }
 
 // Apply transitions a fully-handshaked outgoing conn from pending to active.
+// Piece assignment for the new conn is delegated to the torrentControl's
+// RequestStrategy (see requeststrategy.go) rather than decided here.
 func (e outgoingConnEvent) Apply(s *Scheduler) {
 	s.log("conn", e.c, "torrent", e.info).Debug("Applying outgoing conn event")
 
@@ -172,6 +203,11 @@ func (e outgoingConnEvent) Apply(s *Scheduler) {
 		return
 	}
 	s.log("conn", e.c, "bitfield", e.bitfield).Info("Added outgoing conn")
+
+	if ctrl, ok := s.torrentControls[e.c.InfoHash()]; ok {
+		ctrl.Strategy.RecordBitfield(e.c.InfoHash(), e.bitfield)
+		s.assignPieces(ctrl, e.c)
+	}
 }
 
 // announceTickEvent occurs when it is time to announce to the tracker.
@@ -228,7 +264,7 @@ func (e announceResponseEvent) Apply(s *Scheduler) {
 			// Tracker may return our own peer.
 			continue
 		}
-		if err := s.connState.AddPending(pid, e.infoHash); err != nil {
+		if err := s.connState.AddPendingOutgoing(pid, e.infoHash); err != nil {
 			if err == errTorrentAtCapacity {
 				s.log("hash", e.infoHash).Info(
 					"Cannot open any more connections, torrent is at capacity")
@@ -237,8 +273,10 @@ func (e announceResponseEvent) Apply(s *Scheduler) {
 			s.log("peer", pid, "hash", e.infoHash).Infof("Skipping peer from announce: %s", err)
 			continue
 		}
+		addr := fmt.Sprintf("%s:%d", p.IP, int(p.Port))
+		s.connState.RememberPeer(pid, e.infoHash, addr)
+		registerNATRelayIfNeeded(s, pid, e.infoHash, addr)
 		go func() {
-			addr := fmt.Sprintf("%s:%d", p.IP, int(p.Port))
 			info := ctrl.Dispatcher.Torrent.Stat()
 			c, bitfield, err := s.handshaker.Initialize(pid, addr, info)
 			if err != nil {
@@ -252,6 +290,52 @@ func (e announceResponseEvent) Apply(s *Scheduler) {
 	}
 }
 
+// connBalanceTickEvent occurs periodically to correct torrents whose conns
+// have drifted towards all-incoming or all-outgoing. An incoming-heavy
+// torrent (e.g. an origin/seeder that only ever gets dialed into) never
+// discovers fresh peers from announce, so when a torrent is sitting at its
+// reserved incoming quota but the overall conn cap still has room, the
+// scheduler dials out to peers the announce cache already remembers rather
+// than waiting for the next scheduled announce.
+type connBalanceTickEvent struct{}
+
+// Apply asks s.connState which torrents are incoming-saturated but under
+// their overall cap, and for each one spins up outgoing dials to peers
+// remembered from the torrent's last announce response.
+func (e connBalanceTickEvent) Apply(s *Scheduler) {
+	s.log().Debug("Applying conn balance tick event")
+
+	for infoHash := range s.connState.IncomingSaturatedTorrents() {
+		ctrl, ok := s.torrentControls[infoHash]
+		if !ok || ctrl.Complete {
+			continue
+		}
+		for _, pid := range s.connState.RememberedPeers(infoHash) {
+			if err := s.connState.AddPendingOutgoing(pid, infoHash); err != nil {
+				continue
+			}
+			pid, ctrl := pid, ctrl
+			go func() {
+				addr, ok := s.connState.RememberedAddr(pid, infoHash)
+				if !ok {
+					s.eventLoop.Send(failedHandshakeEvent{pid, infoHash})
+					return
+				}
+				registerNATRelayIfNeeded(s, pid, infoHash, addr)
+				info := ctrl.Dispatcher.Torrent.Stat()
+				c, bitfield, err := s.handshaker.Initialize(pid, addr, info)
+				if err != nil {
+					s.log("peer", pid, "hash", infoHash, "addr", addr).Infof(
+						"Failed balance dial: %s", err)
+					s.eventLoop.Send(failedHandshakeEvent{pid, infoHash})
+					return
+				}
+				s.eventLoop.Send(outgoingConnEvent{c, bitfield, info})
+			}()
+		}
+	}
+}
+
 // announceFailureEvent occurs when an announce request fails.
 type announceFailureEvent struct {
 	dispatcher *dispatcher
@@ -332,6 +416,12 @@ func (e preemptionTickEvent) Apply(s *Scheduler) {
 			ctrl.Dispatcher.LastGoodPieceReceived(c.PeerID()),
 			ctrl.Dispatcher.LastPieceSent(c.PeerID()))
 		if s.clock.Now().Sub(lastProgress) > s.config.IdleConnTTL {
+			if ctrl.Endgame {
+				// Conns waiting on duplicated endgame requests look idle
+				// from the dispatcher's perspective, but are still doing
+				// useful work racing the torrent to completion.
+				continue
+			}
 			s.log("conn", c).Info("Closing idle conn")
 			c.Close()
 			continue
@@ -353,6 +443,21 @@ func (e preemptionTickEvent) Apply(s *Scheduler) {
 			}
 		}
 	}
+
+	// Webseed fetches aren't real conn.Conns, but they're still subject to
+	// the same idle/TTL bookkeeping so a stalled or abandoned URL doesn't
+	// stay tracked forever.
+	for _, wc := range s.connState.WebseedConns() {
+		if s.clock.Now().Sub(wc.lastActive) > s.config.IdleConnTTL {
+			s.log("url", wc.url, "hash", wc.infoHash).Info("Forgetting idle webseed conn")
+			s.connState.DeleteWebseedConn(wc.url, wc.infoHash)
+			continue
+		}
+		if s.clock.Now().Sub(wc.createdAt) > s.config.ConnTTL {
+			s.log("url", wc.url, "hash", wc.infoHash).Info("Forgetting expired webseed conn")
+			s.connState.DeleteWebseedConn(wc.url, wc.infoHash)
+		}
+	}
 }
 
 // cleanupBlacklistEvent occurs periodically to allow the Scheduler to cleanup
@@ -371,6 +476,13 @@ type emitStatsEvent struct{}
 func (e emitStatsEvent) Apply(s *Scheduler) {
 	s.stats.Gauge("torrents").Update(float64(len(s.torrentControls)))
 	s.stats.Gauge("conns").Update(float64(s.connState.NumActiveConns()))
+	s.stats.Gauge("conns.incoming").Update(float64(s.connState.NumIncomingConns()))
+	s.stats.Gauge("conns.outgoing").Update(float64(s.connState.NumOutgoingConns()))
+
+	for infoHash, ctrl := range s.torrentControls {
+		s.stats.Gauge(fmt.Sprintf("webseed.bytes_received.%s", infoHash)).Update(
+			float64(ctrl.WebseedBytesReceived))
+	}
 }
 
 // cancelTorrentEvent occurs when a client of Scheduler manually cancels a torrent.
@@ -400,6 +512,9 @@ func (e cancelTorrentEvent) Apply(s *Scheduler) {
 	}
 }
 
+// webseedTickEvent and webseedPieceReceivedEvent are defined in webseed.go,
+// alongside the rest of the webseed fetching machinery.
+
 type blacklistSnapshotEvent struct {
 	result chan []BlacklistedConn
 }
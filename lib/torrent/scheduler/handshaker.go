@@ -0,0 +1,111 @@
+package scheduler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"code.uber.internal/infra/kraken/lib/torrent/scheduler/conn"
+	"code.uber.internal/infra/kraken/lib/torrent/storage"
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// handshakerConfig configures whether and how handshaker negotiates MSE/PE
+// obfuscation before the plaintext Kraken handshake.
+type handshakerConfig struct {
+	Encryption ConnEncryption
+}
+
+// handshaker drives both sides of conn establishment: accepting an incoming
+// PendingConn's handshake, and dialing + handshaking outgoing conns. Per
+// config.Encryption, it may first negotiate an MSE/PE obfuscation layer (see
+// mse.go) before the normal Kraken handshake proceeds.
+type handshaker struct {
+	config handshakerConfig
+}
+
+func newHandshaker(config handshakerConfig) *handshaker {
+	return &handshaker{config: config}
+}
+
+// Establish completes the handshake for an incoming PendingConn. If
+// encryption is not disabled, it first peeks the conn's opening bytes to
+// decide whether the dialer is speaking plaintext Kraken or MSE/PE: a
+// plaintext preamble is handed straight to the normal handshake, anything
+// else is treated as the start of an MSE/PE DH exchange.
+func (h *handshaker) Establish(pc *conn.PendingConn, info *storage.TorrentInfo) (*conn.Conn, error) {
+	if h.config.Encryption != ConnEncryptionDisabled {
+		peek, err := pc.Peek(len(krakenHandshakePreamble))
+		if err != nil {
+			if h.config.Encryption == ConnEncryptionRequired {
+				return nil, fmt.Errorf("peek for encryption sniff: %s", err)
+			}
+		} else if sniffEncryption(peek) {
+			cipher, err := probeMSE(newMSETransport(pc), info.InfoHash().Bytes())
+			if err != nil {
+				return nil, fmt.Errorf("MSE/PE handshake: %s", err)
+			}
+			pc.SetCipher(cipher)
+		} else if h.config.Encryption == ConnEncryptionRequired {
+			return nil, errors.New("MSE/PE required but peer attempted a plaintext handshake")
+		}
+	}
+	return pc.Handshake(info)
+}
+
+// Initialize dials addr and handshakes as peerID. If encryption is
+// preferred or required, it probes MSE/PE first; ConnEncryptionRequired
+// fails the dial outright if the peer does not respond to the DH exchange,
+// while ConnEncryptionPreferred falls back to a plaintext handshake.
+func (h *handshaker) Initialize(
+	peerID torlib.PeerID, addr string, info *storage.TorrentInfo) (*conn.Conn, storage.Bitfield, error) {
+
+	pc, err := conn.DialPending(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial: %s", err)
+	}
+
+	if h.config.Encryption != ConnEncryptionDisabled {
+		cipher, err := probeMSE(newMSETransport(pc), info.InfoHash().Bytes())
+		if err != nil {
+			if h.config.Encryption == ConnEncryptionRequired {
+				pc.Close()
+				return nil, nil, fmt.Errorf("MSE/PE handshake: %s", err)
+			}
+		} else {
+			pc.SetCipher(cipher)
+		}
+	}
+
+	return pc.HandshakeOutgoing(peerID, info)
+}
+
+// mseTransportIO adapts an io.ReadWriter (the raw, not-yet-handshaked
+// PendingConn socket) into the length-prefixed mseTransport probeMSE needs
+// to exchange DH public keys.
+type mseTransportIO struct {
+	rw io.ReadWriter
+}
+
+func newMSETransport(rw io.ReadWriter) mseTransport {
+	return &mseTransportIO{rw: rw}
+}
+
+func (t *mseTransportIO) WriteDH(pub []byte) error {
+	if err := binary.Write(t.rw, binary.BigEndian, uint16(len(pub))); err != nil {
+		return err
+	}
+	_, err := t.rw.Write(pub)
+	return err
+}
+
+func (t *mseTransportIO) ReadDH() ([]byte, error) {
+	var n uint16
+	if err := binary.Read(t.rw, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(t.rw, buf)
+	return buf, err
+}
@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"net"
+	"time"
+
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// holepunchDialDelay is how far in the future the scheduler schedules its
+// simultaneous-dial attempt after receiving a rendezvous connect signal,
+// giving the relay time to deliver the same signal to the peer on the other
+// end.
+const holepunchDialDelay = 2 * time.Second
+
+// privateAddrBlocks are the RFC 1918 private ranges, loopback, and
+// link-local block, used by isNATAddr to recognize an address a peer
+// announced that this scheduler cannot dial directly from outside that
+// peer's network.
+var privateAddrBlocks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	blocks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blocks[i] = block
+	}
+	return blocks
+}
+
+// isNATAddr reports whether addr's host is a private/NAT address: the
+// heuristic the scheduler uses to proactively register a relay for a peer
+// before ever attempting to dial it, rather than waiting to learn it's
+// unreachable the hard way.
+func isNATAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, block := range privateAddrBlocks {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// registerNATRelayIfNeeded checks whether addr looks like a NAT address for
+// target/infoHash and, if so, designates any other currently active conn on
+// the same torrent as the relay a holepunch rendezvous can later be routed
+// through if a direct dial to addr fails. Called from the dial paths
+// (announce responses, conn balancing) as soon as a candidate address is
+// known, since that's the only point that actually observes it.
+func registerNATRelayIfNeeded(s *Scheduler, target torlib.PeerID, infoHash torlib.InfoHash, addr string) {
+	if !isNATAddr(addr) {
+		return
+	}
+	for _, c := range s.connState.ActiveConnsForTorrent(infoHash) {
+		if c.PeerID() == target {
+			continue
+		}
+		s.connState.SetNATRelay(target, infoHash, c.PeerID())
+		return
+	}
+}
+
+// holepunchRendezvousEvent occurs when a handshake with a peer fails, in
+// either direction, and registerNATRelayIfNeeded earlier recorded a relay
+// for that peer: it announced a private/NAT address while the scheduler had
+// an established conn to another peer (the "relay") in the same swarm that
+// the tracker can route hole-punch messages through. The kind of handshake
+// failure is not inspected, and the local peer's own address is not checked.
+//
+// Modeled on the BEP 55 ut_holepunch extension: rather than dialing the
+// unreachable peer directly, the scheduler asks the tracker to have the
+// relay signal both endpoints to dial each other at the same time.
+type holepunchRendezvousEvent struct {
+	infoHash torlib.InfoHash
+	target   torlib.PeerID
+	relay    torlib.PeerID
+}
+
+// Apply asks the tracker to route a "rendezvous" message from the relay to
+// the target peer, asking both ends to dial each other. The tracker's
+// response (or the peer's own outbound connect) arrives back as a
+// holepunchEvent.
+func (e holepunchRendezvousEvent) Apply(s *Scheduler) {
+	s.log("peer", e.target, "relay", e.relay, "hash", e.infoHash).Info(
+		"Applying holepunch rendezvous event")
+
+	go func() {
+		if err := s.tracker.SendHolepunchRendezvous(e.infoHash, e.target, e.relay); err != nil {
+			s.log("peer", e.target, "hash", e.infoHash).Infof(
+				"Error requesting holepunch rendezvous: %s", err)
+			return
+		}
+	}()
+}
+
+// holepunchEvent occurs when the tracker relays a "connect" message telling
+// the local peer to simultaneously dial target at addr. Both ends of the NAT
+// pair receive this at roughly the same time, so the simultaneous outbound
+// SYNs from either side punch a hole through each peer's NAT for the other.
+type holepunchEvent struct {
+	infoHash torlib.InfoHash
+	target   torlib.PeerID
+	addr     string
+}
+
+// Apply waits out holepunchDialDelay to give the tracker time to deliver the
+// matching signal to the other endpoint, then attempts a normal outbound
+// handshake against addr. From here it rejoins the regular handshake path:
+// success produces an outgoingConnEvent, failure a failedHandshakeEvent.
+func (e holepunchEvent) Apply(s *Scheduler) {
+	s.log("peer", e.target, "addr", e.addr, "hash", e.infoHash).Info(
+		"Applying holepunch event, scheduling simultaneous dial")
+
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		return
+	}
+	if err := s.connState.AddPendingOutgoing(e.target, e.infoHash); err != nil {
+		s.log("peer", e.target, "hash", e.infoHash).Infof(
+			"Skipping holepunch dial: %s", err)
+		return
+	}
+	info := ctrl.Dispatcher.Torrent.Stat()
+	go func() {
+		s.clock.Sleep(holepunchDialDelay)
+		c, bitfield, err := s.handshaker.Initialize(e.target, e.addr, info)
+		if err != nil {
+			s.log("peer", e.target, "hash", e.infoHash, "addr", e.addr).Infof(
+				"Failed holepunch dial: %s", err)
+			s.eventLoop.Send(failedHandshakeEvent{e.target, e.infoHash})
+			return
+		}
+		s.eventLoop.Send(outgoingConnEvent{c, bitfield, info})
+	}()
+}
@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// holepunchPollBackoff is how long ListenHolepunch waits before retrying
+// after a failed long-poll against the tracker.
+const holepunchPollBackoff = 5 * time.Second
+
+// holepunchMessage is the wire format the tracker uses to route
+// "rendezvous", "connect", and "error" messages between the two peers of a
+// NAT pair it cannot dial directly, per the ut_holepunch-style protocol
+// extension described in holepunch.go.
+type holepunchMessage struct {
+	Type     string `json:"type"`
+	InfoHash string `json:"info_hash"`
+	Target   string `json:"target"`
+	Relay    string `json:"relay,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// tracker is the scheduler's client for the tracker's holepunch protocol
+// extension: SendHolepunchRendezvous is the send half (asking the tracker to
+// broker a rendezvous), ListenHolepunch is the receive half (learning that a
+// peer wants to rendezvous with us).
+type tracker struct {
+	addr       string
+	peerID     torlib.PeerID
+	httpClient *http.Client
+}
+
+func newTracker(addr string, peerID torlib.PeerID) *tracker {
+	return &tracker{
+		addr:       addr,
+		peerID:     peerID,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// SendHolepunchRendezvous asks the tracker to relay a "rendezvous" message
+// from relay to target, asking both ends of infoHash's NAT pair to dial each
+// other simultaneously.
+func (t *tracker) SendHolepunchRendezvous(
+	infoHash torlib.InfoHash, target, relay torlib.PeerID) error {
+
+	return t.postHolepunch(holepunchMessage{
+		Type:     "rendezvous",
+		InfoHash: infoHash.String(),
+		Target:   target.String(),
+		Relay:    relay.String(),
+	})
+}
+
+func (t *tracker) postHolepunch(msg holepunchMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal holepunch message: %s", err)
+	}
+	resp, err := t.httpClient.Post(t.addr+"/holepunch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("post holepunch message: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ListenHolepunch long-polls the tracker's holepunch stream for this peer
+// until stopc is closed, decoding each relayed message. A "connect" message
+// is turned into a holepunchEvent and sent into s's event loop so the event
+// loop schedules the simultaneous dial; an "error" message (e.g. the other
+// end never announced, or the relay itself is gone) is just logged, since
+// there is nothing left to dial.
+func (t *tracker) ListenHolepunch(s *Scheduler, stopc <-chan struct{}) {
+	for {
+		select {
+		case <-stopc:
+			return
+		default:
+		}
+
+		msg, err := t.pollHolepunch()
+		if err != nil {
+			s.log("peer", t.peerID).Infof("Error polling holepunch stream: %s", err)
+			time.Sleep(holepunchPollBackoff)
+			continue
+		}
+
+		infoHash, err := torlib.NewInfoHashFromString(msg.InfoHash)
+		if err != nil {
+			s.log("hash", msg.InfoHash).Errorf("Invalid info hash in holepunch message: %s", err)
+			continue
+		}
+		target, err := torlib.NewPeerID(msg.Target)
+		if err != nil {
+			s.log("peer", msg.Target, "hash", infoHash).Errorf(
+				"Invalid peer id in holepunch message: %s", err)
+			continue
+		}
+
+		switch msg.Type {
+		case "connect":
+			s.eventLoop.Send(holepunchEvent{infoHash, target, msg.Addr})
+		case "error":
+			s.log("peer", target, "hash", infoHash).Infof(
+				"Tracker reported holepunch error: %s", msg.Reason)
+		default:
+			s.log("peer", target, "hash", infoHash).Errorf(
+				"Unknown holepunch message type: %s", msg.Type)
+		}
+	}
+}
+
+func (t *tracker) pollHolepunch() (holepunchMessage, error) {
+	url := fmt.Sprintf("%s/holepunch/stream?peer_id=%s", t.addr, t.peerID.String())
+	resp, err := t.httpClient.Get(url)
+	if err != nil {
+		return holepunchMessage{}, fmt.Errorf("get holepunch stream: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return holepunchMessage{}, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var msg holepunchMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return holepunchMessage{}, fmt.Errorf("decode holepunch message: %s", err)
+	}
+	return msg, nil
+}
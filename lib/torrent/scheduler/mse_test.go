@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDHSharedSecretAgreesOnBothEnds(t *testing.T) {
+	require := require.New(t)
+
+	privA, pubA, err := dhGenerateKeyPair()
+	require.NoError(err)
+	privB, pubB, err := dhGenerateKeyPair()
+	require.NoError(err)
+
+	secretA := dhSharedSecret(privA, pubB.Bytes())
+	secretB := dhSharedSecret(privB, pubA.Bytes())
+	require.Equal(secretA, secretB)
+}
+
+func TestNewMSECipherRoundTripsBetweenBothEnds(t *testing.T) {
+	require := require.New(t)
+
+	privA, pubA, err := dhGenerateKeyPair()
+	require.NoError(err)
+	privB, pubB, err := dhGenerateKeyPair()
+	require.NoError(err)
+
+	infoHash := []byte("0123456789abcdefghij")
+
+	secretA := dhSharedSecret(privA, pubB.Bytes())
+	secretB := dhSharedSecret(privB, pubA.Bytes())
+
+	cipherA, err := newMSECipher(secretA, infoHash)
+	require.NoError(err)
+	cipherB, err := newMSECipher(secretB, infoHash)
+	require.NoError(err)
+
+	msg := []byte("hello from A")
+	cipherA.Encrypt(msg)
+
+	// B decrypts what A encrypted, since A's encrypt key is B's decrypt key.
+	cipherB.Decrypt(msg)
+	require.Equal([]byte("hello from A"), msg)
+
+	reply := []byte("hello from B")
+	cipherB.Encrypt(reply)
+	cipherA.Decrypt(reply)
+	require.Equal([]byte("hello from B"), reply)
+}
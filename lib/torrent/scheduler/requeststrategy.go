@@ -0,0 +1,237 @@
+package scheduler
+
+import (
+	"math/rand"
+	"sort"
+
+	"code.uber.internal/infra/kraken/lib/torrent/scheduler/conn"
+	"code.uber.internal/infra/kraken/lib/torrent/storage"
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// RequestStrategy decides which conns a piece should be requested from, and
+// which pieces a given conn should be asked for next. It replaces the
+// scheduler's previous implicit, inline policy, so that different torrents
+// can drive their piece assignment differently without touching the
+// announce/incoming/outgoing conn paths themselves.
+//
+// Implementations are called directly from the event loop and must not
+// block or spawn goroutines that mutate Scheduler state -- the event loop
+// stays single-threaded so strategies never need their own locking.
+type RequestStrategy interface {
+
+	// ChoosePeersForPiece selects which of candidates should be asked for
+	// pieceIndex of infoHash, in priority order.
+	ChoosePeersForPiece(
+		infoHash torlib.InfoHash, pieceIndex int, candidates []*conn.Conn) []*conn.Conn
+
+	// NextPieces selects up to budget piece indices that peer should be
+	// asked for next, given the current state of ctrl.
+	NextPieces(ctrl *torrentControl, peer *conn.Conn, budget int) []int
+
+	// RecordBitfield tells the strategy that a peer handshaked for infoHash
+	// announcing it already has bitfield, so piece-availability-driven
+	// strategies can fold it into their ordering. Called once per conn, at
+	// handshake time.
+	RecordBitfield(infoHash torlib.InfoHash, bitfield storage.Bitfield)
+
+	// RecordHave tells the strategy that some peer for infoHash announced
+	// (via a wire HAVE message, after handshake) that it now has
+	// pieceIndex. See pieceAnnouncedEvent.
+	RecordHave(infoHash torlib.InfoHash, pieceIndex int)
+}
+
+// defaultPieceRequestBudget caps how many pieces are requested from a single
+// conn the moment it becomes active, before its normal piece-completion flow
+// takes over requesting more.
+const defaultPieceRequestBudget = 10
+
+// assignPieces is the actual call site for RequestStrategy: it asks ctrl's
+// strategy which pieces peer should be asked for next, and issues the
+// requests. Called whenever a conn newly becomes active, replacing what used
+// to be the scheduler's implicit, inline piece-assignment policy.
+func (s *Scheduler) assignPieces(ctrl *torrentControl, peer *conn.Conn) {
+	pieces := ctrl.Strategy.NextPieces(ctrl, peer, defaultPieceRequestBudget)
+	if len(pieces) == 0 {
+		return
+	}
+	if err := peer.RequestPieces(pieces); err != nil {
+		s.log("conn", peer).Infof("Error requesting pieces chosen by strategy: %s", err)
+	}
+}
+
+// pieceAvailability tracks, for a single torrent, how many known peers have
+// announced (via HAVE / BITFIELD) that they have each piece. It backs the
+// rarest-first strategy's piece ordering.
+type pieceAvailability struct {
+	counts map[int]int
+}
+
+func newPieceAvailability() *pieceAvailability {
+	return &pieceAvailability{counts: make(map[int]int)}
+}
+
+func (a *pieceAvailability) addHave(pieceIndex int) {
+	a.counts[pieceIndex]++
+}
+
+func (a *pieceAvailability) removeHave(pieceIndex int) {
+	if a.counts[pieceIndex] > 0 {
+		a.counts[pieceIndex]--
+	}
+}
+
+// rarestFirstStrategy prioritizes pieces that the fewest known peers have,
+// so that scarce pieces propagate through the swarm before they become
+// unavailable entirely.
+type rarestFirstStrategy struct {
+	availability map[torlib.InfoHash]*pieceAvailability
+}
+
+// NewRarestFirstStrategy returns a RequestStrategy that always requests the
+// least-available missing pieces first.
+func NewRarestFirstStrategy() RequestStrategy {
+	return &rarestFirstStrategy{
+		availability: make(map[torlib.InfoHash]*pieceAvailability),
+	}
+}
+
+func (s *rarestFirstStrategy) ChoosePeersForPiece(
+	infoHash torlib.InfoHash, pieceIndex int, candidates []*conn.Conn) []*conn.Conn {
+
+	return candidates
+}
+
+// availabilityFor returns infoHash's pieceAvailability, creating it if this
+// is the first time infoHash has been seen.
+func (s *rarestFirstStrategy) availabilityFor(infoHash torlib.InfoHash) *pieceAvailability {
+	avail, ok := s.availability[infoHash]
+	if !ok {
+		avail = newPieceAvailability()
+		s.availability[infoHash] = avail
+	}
+	return avail
+}
+
+func (s *rarestFirstStrategy) RecordBitfield(infoHash torlib.InfoHash, bitfield storage.Bitfield) {
+	avail := s.availabilityFor(infoHash)
+	for pieceIndex, has := range bitfield {
+		if has {
+			avail.addHave(pieceIndex)
+		}
+	}
+}
+
+func (s *rarestFirstStrategy) RecordHave(infoHash torlib.InfoHash, pieceIndex int) {
+	s.availabilityFor(infoHash).addHave(pieceIndex)
+}
+
+func (s *rarestFirstStrategy) NextPieces(ctrl *torrentControl, peer *conn.Conn, budget int) []int {
+	avail := s.availabilityFor(ctrl.Dispatcher.Torrent.InfoHash())
+
+	missing := ctrl.Dispatcher.Torrent.MissingPieces()
+	sort.Slice(missing, func(i, j int) bool {
+		return avail.counts[missing[i]] < avail.counts[missing[j]]
+	})
+	if len(missing) > budget {
+		missing = missing[:budget]
+	}
+	return missing
+}
+
+// fastestFirstStrategy orders the candidate conns for a piece by their EWMA
+// download rate, fastest first, and hands every conn a random shuffle of the
+// missing pieces to avoid every peer piling onto the same piece. It has no
+// notion of piece priority: the fastest conn is not given a different set of
+// pieces from the other conns.
+type fastestFirstStrategy struct {
+	rand *rand.Rand
+}
+
+// NewFastestFirstStrategy returns a RequestStrategy that ranks the
+// highest-throughput conns first when choosing peers for a piece.
+func NewFastestFirstStrategy() RequestStrategy {
+	return &fastestFirstStrategy{rand: rand.New(rand.NewSource(1))}
+}
+
+func (s *fastestFirstStrategy) ChoosePeersForPiece(
+	infoHash torlib.InfoHash, pieceIndex int, candidates []*conn.Conn) []*conn.Conn {
+
+	sorted := make([]*conn.Conn, len(candidates))
+	copy(sorted, candidates)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Stats().EWMADownloadRate() > sorted[j].Stats().EWMADownloadRate()
+	})
+	return sorted
+}
+
+func (s *fastestFirstStrategy) NextPieces(ctrl *torrentControl, peer *conn.Conn, budget int) []int {
+	missing := ctrl.Dispatcher.Torrent.MissingPieces()
+	s.rand.Shuffle(len(missing), func(i, j int) {
+		missing[i], missing[j] = missing[j], missing[i]
+	})
+	if len(missing) > budget {
+		missing = missing[:budget]
+	}
+	return missing
+}
+
+// RecordBitfield is a no-op: fastestFirstStrategy orders purely by conn
+// throughput, not piece availability.
+func (s *fastestFirstStrategy) RecordBitfield(infoHash torlib.InfoHash, bitfield storage.Bitfield) {}
+
+// RecordHave is a no-op for the same reason as RecordBitfield.
+func (s *fastestFirstStrategy) RecordHave(infoHash torlib.InfoHash, pieceIndex int) {}
+
+// sequentialStrategy requests pieces strictly in index order, which is
+// suited to streaming use cases where the consumer reads the torrent's
+// content from front to back.
+type sequentialStrategy struct{}
+
+// NewSequentialStrategy returns a RequestStrategy that always requests the
+// lowest-indexed missing piece next.
+func NewSequentialStrategy() RequestStrategy {
+	return &sequentialStrategy{}
+}
+
+func (s *sequentialStrategy) ChoosePeersForPiece(
+	infoHash torlib.InfoHash, pieceIndex int, candidates []*conn.Conn) []*conn.Conn {
+
+	return candidates
+}
+
+func (s *sequentialStrategy) NextPieces(ctrl *torrentControl, peer *conn.Conn, budget int) []int {
+	missing := ctrl.Dispatcher.Torrent.MissingPieces()
+	sort.Ints(missing)
+	if len(missing) > budget {
+		missing = missing[:budget]
+	}
+	return missing
+}
+
+// RecordBitfield is a no-op: sequentialStrategy orders purely by piece
+// index, not availability.
+func (s *sequentialStrategy) RecordBitfield(infoHash torlib.InfoHash, bitfield storage.Bitfield) {}
+
+// RecordHave is a no-op for the same reason as RecordBitfield.
+func (s *sequentialStrategy) RecordHave(infoHash torlib.InfoHash, pieceIndex int) {}
+
+// pieceAnnouncedEvent occurs when an active conn announces, via a wire HAVE
+// message, that it now has a piece it didn't have at handshake time. This is
+// the call site that keeps piece-availability-driven strategies (e.g.
+// rarestFirstStrategy) up to date as the swarm's piece distribution shifts
+// after the initial bitfield exchange, mirroring how
+// incomingConnEvent/outgoingConnEvent record the handshake-time bitfield.
+type pieceAnnouncedEvent struct {
+	infoHash   torlib.InfoHash
+	pieceIndex int
+}
+
+// Apply feeds the HAVE announcement into infoHash's RequestStrategy.
+func (e pieceAnnouncedEvent) Apply(s *Scheduler) {
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		return
+	}
+	ctrl.Strategy.RecordHave(e.infoHash, e.pieceIndex)
+}
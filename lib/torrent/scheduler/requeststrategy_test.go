@@ -0,0 +1,58 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"code.uber.internal/infra/kraken/lib/torrent/storage"
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// NextPieces/ChoosePeersForPiece themselves take a *torrentControl and
+// *conn.Conn, whose backing types (dispatcher, storage.Torrent, conn.Conn)
+// aren't available to construct a fake of in isolation here. RecordBitfield/RecordHave and pieceAvailability, the pure
+// logic backing rarestFirstStrategy's ordering, have no such dependency, so
+// they're covered directly.
+func TestPieceAvailabilityAddAndRemoveHave(t *testing.T) {
+	require := require.New(t)
+
+	a := newPieceAvailability()
+	require.Equal(0, a.counts[0])
+
+	a.addHave(0)
+	a.addHave(0)
+	a.addHave(1)
+	require.Equal(2, a.counts[0])
+	require.Equal(1, a.counts[1])
+
+	a.removeHave(0)
+	require.Equal(1, a.counts[0])
+
+	// removeHave never goes negative.
+	a.removeHave(1)
+	a.removeHave(1)
+	require.Equal(0, a.counts[1])
+}
+
+func TestRarestFirstStrategyRecordBitfieldAndHave(t *testing.T) {
+	require := require.New(t)
+
+	s := NewRarestFirstStrategy().(*rarestFirstStrategy)
+	infoHash := torlib.InfoHash{}
+
+	s.RecordBitfield(infoHash, storage.Bitfield{true, false, true})
+	avail := s.availabilityFor(infoHash)
+	require.Equal(1, avail.counts[0])
+	require.Equal(0, avail.counts[1])
+	require.Equal(1, avail.counts[2])
+
+	s.RecordHave(infoHash, 1)
+	require.Equal(1, avail.counts[1])
+
+	// A second peer's bitfield accumulates rather than overwriting.
+	s.RecordBitfield(infoHash, storage.Bitfield{true, true, false})
+	require.Equal(2, avail.counts[0])
+	require.Equal(2, avail.counts[1])
+	require.Equal(1, avail.counts[2])
+}
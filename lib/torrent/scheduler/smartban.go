@@ -0,0 +1,179 @@
+package scheduler
+
+import (
+	"hash/crc32"
+	"sync"
+
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// blockCRC is the CRC32 of a single block's bytes, along with the block's
+// length -- both are needed to re-slice the reassembled bad piece back down
+// to exactly the bytes a given peer contributed.
+type blockCRC struct {
+	crc    uint32
+	length int
+}
+
+// blockCRCs maps a block's offset within a piece to the blockCRC of the
+// bytes that peer supplied for it.
+type blockCRCs map[int64]blockCRC
+
+// pieceContributors tracks, for a single in-flight piece, which peers
+// supplied which blocks so that a failed hash check can be attributed to the
+// peer(s) responsible.
+type pieceContributors struct {
+	sync.Mutex
+	// pieces maps infoHash+pieceIndex to the set of peers that
+	// contributed blocks, and the CRCs of the bytes they sent.
+	pieces map[smartBanKey]map[torlib.PeerID]blockCRCs
+}
+
+type smartBanKey struct {
+	infoHash torlib.InfoHash
+	piece    int
+}
+
+func newPieceContributors() *pieceContributors {
+	return &pieceContributors{
+		pieces: make(map[smartBanKey]map[torlib.PeerID]blockCRCs),
+	}
+}
+
+// recordBlock records that peerID supplied the block at blockOffset of
+// infoHash/pieceIndex with the given bytes.
+func (pc *pieceContributors) recordBlock(
+	infoHash torlib.InfoHash, pieceIndex int, peerID torlib.PeerID, blockOffset int64, b []byte) {
+
+	pc.Lock()
+	defer pc.Unlock()
+
+	key := smartBanKey{infoHash, pieceIndex}
+	peers, ok := pc.pieces[key]
+	if !ok {
+		peers = make(map[torlib.PeerID]blockCRCs)
+		pc.pieces[key] = peers
+	}
+	crcs, ok := peers[peerID]
+	if !ok {
+		crcs = make(blockCRCs)
+		peers[peerID] = crcs
+	}
+	crcs[blockOffset] = blockCRC{crc: crc32.ChecksumIEEE(b), length: len(b)}
+}
+
+// evict discards all contributor bookkeeping for infoHash/pieceIndex. Must be
+// called whenever a piece completes, successfully or not, so that memory
+// stays proportional to in-flight pieces rather than growing unboundedly.
+func (pc *pieceContributors) evict(infoHash torlib.InfoHash, pieceIndex int) map[torlib.PeerID]blockCRCs {
+	pc.Lock()
+	defer pc.Unlock()
+
+	key := smartBanKey{infoHash, pieceIndex}
+	contributors := pc.pieces[key]
+	delete(pc.pieces, key)
+	return contributors
+}
+
+// pieceHashFailedEvent occurs when a completed piece fails its SHA check.
+// Its contributors map records, for every peer that sent a block toward the
+// reassembled piece, the CRC of the bytes that peer sent -- allowing us to
+// identify exactly which peer(s) fed us the bad data.
+type pieceHashFailedEvent struct {
+	infoHash     torlib.InfoHash
+	pieceIndex   int
+	badPiece     []byte
+	contributors map[torlib.PeerID]blockCRCs
+}
+
+// Apply replays each contributor's recorded block CRCs against the bad piece
+// bytes. A peer whose blocks still match the corresponding range of the bad
+// piece is blacklisted with an extended TTL and has its active conn torn
+// down, since its data is what ended up in the corrupted piece. A peer whose
+// CRCs no longer match was overwritten by a later duplicate request (e.g.
+// during endgame) and is exonerated.
+func (e pieceHashFailedEvent) Apply(s *Scheduler) {
+	s.log("hash", e.infoHash, "piece", e.pieceIndex).Info(
+		"Applying piece hash failed event, smart-banning contributors")
+
+	for peerID, crcs := range e.contributors {
+		banned := false
+		for blockOffset, bc := range crcs {
+			start := int(blockOffset)
+			end := start + bc.length
+			if start < 0 || end > len(e.badPiece) {
+				continue
+			}
+			if crc32.ChecksumIEEE(e.badPiece[start:end]) == bc.crc {
+				banned = true
+				break
+			}
+		}
+		if !banned {
+			s.log("peer", peerID, "hash", e.infoHash).Debug(
+				"Exonerating peer from smart ban, block was overwritten")
+			continue
+		}
+		s.log("peer", peerID, "hash", e.infoHash).Info(
+			"Smart-banning peer for contributing to hash check failure")
+		if err := s.connState.BlacklistExtended(peerID, e.infoHash); err != nil {
+			s.log("peer", peerID, "hash", e.infoHash).Infof(
+				"Error smart-banning peer: %s", err)
+			continue
+		}
+		if c, ok := s.connState.ActiveConn(peerID, e.infoHash); ok {
+			c.Close()
+		}
+	}
+	s.stats.Counter("smartban.pieces").Inc(1)
+}
+
+// blockReceivedEvent occurs when a conn finishes reading a single block of a
+// piece off the wire. This is the call site that actually drives smart-ban
+// bookkeeping: every block is recorded against its contributing peer before
+// being handed to the dispatcher, and once the dispatcher reports the piece
+// as complete, the recorded CRCs are either discarded (success) or escalated
+// into a pieceHashFailedEvent (failure).
+type blockReceivedEvent struct {
+	infoHash    torlib.InfoHash
+	pieceIndex  int
+	peerID      torlib.PeerID
+	blockOffset int64
+	data        []byte
+}
+
+// Apply records e's block against its contributing peer, writes it through
+// to the dispatcher, and -- once the piece is complete -- either evicts the
+// contributor bookkeeping (on a successful hash check) or sends a
+// pieceHashFailedEvent carrying it (on a failed one).
+func (e blockReceivedEvent) Apply(s *Scheduler) {
+	s.log("peer", e.peerID, "hash", e.infoHash, "piece", e.pieceIndex).Debug(
+		"Applying block received event")
+
+	s.pieceContributors.recordBlock(e.infoHash, e.pieceIndex, e.peerID, e.blockOffset, e.data)
+
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		return
+	}
+	if err := ctrl.Dispatcher.WriteBlock(e.peerID, e.pieceIndex, e.blockOffset, e.data); err != nil {
+		s.log("peer", e.peerID, "hash", e.infoHash, "piece", e.pieceIndex).Infof(
+			"Error writing block: %s", err)
+		return
+	}
+	if !ctrl.Dispatcher.Torrent.PieceComplete(e.pieceIndex) {
+		return
+	}
+
+	contributors := s.pieceContributors.evict(e.infoHash, e.pieceIndex)
+	if ctrl.Dispatcher.Torrent.VerifyPiece(e.pieceIndex) {
+		return
+	}
+	badPiece, err := ctrl.Dispatcher.Torrent.ReadPiece(e.pieceIndex)
+	if err != nil {
+		s.log("hash", e.infoHash, "piece", e.pieceIndex).Infof(
+			"Error reading bad piece for smart ban: %s", err)
+		return
+	}
+	s.eventLoop.Send(pieceHashFailedEvent{e.infoHash, e.pieceIndex, badPiece, contributors})
+}
@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// badPieceCRCMatches replays the same offset/length-aware CRC comparison
+// pieceHashFailedEvent.Apply performs, without requiring a *Scheduler.
+func badPieceCRCMatches(badPiece []byte, blockOffset int64, bc blockCRC) bool {
+	start := int(blockOffset)
+	end := start + bc.length
+	if start < 0 || end > len(badPiece) {
+		return false
+	}
+	return crc32.ChecksumIEEE(badPiece[start:end]) == bc.crc
+}
+
+func TestPieceContributorsRecordBlockAndEvict(t *testing.T) {
+	require := require.New(t)
+
+	pc := newPieceContributors()
+	infoHash := torlib.InfoHash{}
+	peerID := torlib.PeerID{}
+
+	block1 := []byte("the first block of the piece")
+	block2 := []byte("the second, shorter, block")
+
+	pc.recordBlock(infoHash, 0, peerID, 0, block1)
+	pc.recordBlock(infoHash, 0, peerID, int64(len(block1)), block2)
+
+	contributors := pc.evict(infoHash, 0)
+	require.Len(contributors, 1)
+
+	crcs := contributors[peerID]
+	require.Len(crcs, 2)
+	require.Equal(blockCRC{crc: crc32.ChecksumIEEE(block1), length: len(block1)}, crcs[0])
+	require.Equal(
+		blockCRC{crc: crc32.ChecksumIEEE(block2), length: len(block2)},
+		crcs[int64(len(block1))])
+
+	// Evicting clears the bookkeeping for that piece.
+	require.Empty(pc.evict(infoHash, 0))
+}
+
+func TestBadPieceCRCMatchNonLastBlock(t *testing.T) {
+	require := require.New(t)
+
+	block1 := []byte("0123456789") // not the last block in the piece
+	block2 := []byte("abcdefghij")
+	badPiece := append(append([]byte{}, block1...), block2...)
+
+	bc := blockCRC{crc: crc32.ChecksumIEEE(block1), length: len(block1)}
+
+	// Matches only the exact [offset, offset+length) slice, not
+	// badPiece[offset:] through the end of the piece.
+	require.True(badPieceCRCMatches(badPiece, 0, bc))
+	require.False(badPieceCRCMatches(badPiece, 0, blockCRC{crc: bc.crc, length: len(badPiece)}))
+}
+
+func TestBadPieceCRCMatchOverwrittenBlockIsExonerated(t *testing.T) {
+	require := require.New(t)
+
+	original := []byte("original-block-bytes")
+	overwritten := []byte("overwritten-by-dup!!")
+	require.Equal(len(original), len(overwritten))
+
+	bc := blockCRC{crc: crc32.ChecksumIEEE(original), length: len(original)}
+
+	require.False(badPieceCRCMatches(overwritten, 0, bc))
+}
@@ -0,0 +1,39 @@
+package scheduler
+
+// torrentControl bundles the dispatcher for a single torrent along with the
+// Scheduler-level bookkeeping that spans its lifetime: pending completion
+// callbacks, whether it has finished downloading, whether it is currently in
+// endgame, and the RequestStrategy driving its piece assignment.
+type torrentControl struct {
+	Dispatcher *dispatcher
+	Errors     []chan error
+	Complete   bool
+
+	// Endgame is true once the torrent has dropped at or below its endgame
+	// missing-piece threshold. See endgame.go.
+	Endgame bool
+
+	// Strategy decides which peers a piece is requested from and which
+	// pieces a given peer is asked for next. Defaults to rarest-first; set
+	// via torrentControl.SetStrategy for torrents that want different
+	// behavior (e.g. sequential for streaming). See requeststrategy.go.
+	Strategy RequestStrategy
+
+	// WebseedBytesReceived is the cumulative number of bytes fetched from
+	// webseed URLs for this torrent. Accumulated by
+	// webseedPieceReceivedEvent and periodically reported as a per-torrent
+	// gauge by emitStatsEvent. See webseed.go.
+	WebseedBytesReceived int64
+}
+
+func newTorrentControl(d *dispatcher) *torrentControl {
+	return &torrentControl{
+		Dispatcher: d,
+		Strategy:   NewRarestFirstStrategy(),
+	}
+}
+
+// SetStrategy overrides the torrent's default RequestStrategy.
+func (c *torrentControl) SetStrategy(s RequestStrategy) {
+	c.Strategy = s
+}
@@ -0,0 +1,292 @@
+package scheduler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.uber.internal/infra/kraken/lib/torrent/storage"
+	"code.uber.internal/infra/kraken/torlib"
+)
+
+// webseedBackoffThreshold is the number of consecutive hash-check or
+// transport failures a webseed URL may accumulate before it is skipped by
+// future ticks until its cooldown elapses.
+const webseedBackoffThreshold = 3
+
+// webseedBackoffCooldown is how long a URL that has crossed
+// webseedBackoffThreshold is skipped for, before it is given another chance.
+// This makes backoff recoverable: unlike a permanent ban, a webseed origin
+// that was briefly overloaded or flaky will be retried again once the
+// cooldown elapses.
+const webseedBackoffCooldown = 30 * time.Second
+
+// webseedBackoff tracks consecutive failures per webseed URL so that a
+// misbehaving or overloaded origin does not get hammered with retries.
+type webseedBackoff struct {
+	sync.Mutex
+	failures    map[string]int
+	bannedUntil map[string]time.Time
+}
+
+func newWebseedBackoff() *webseedBackoff {
+	return &webseedBackoff{
+		failures:    make(map[string]int),
+		bannedUntil: make(map[string]time.Time),
+	}
+}
+
+func (b *webseedBackoff) record(url string) {
+	b.Lock()
+	defer b.Unlock()
+	b.failures[url]++
+	if b.failures[url] >= webseedBackoffThreshold {
+		b.bannedUntil[url] = time.Now().Add(webseedBackoffCooldown)
+	}
+}
+
+func (b *webseedBackoff) reset(url string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.failures, url)
+	delete(b.bannedUntil, url)
+}
+
+// blocked returns whether url is currently in its backoff cooldown. Once the
+// cooldown elapses, the URL's failure count is reset so it gets a full
+// webseedBackoffThreshold worth of attempts before being banned again.
+func (b *webseedBackoff) blocked(url string) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	until, ok := b.bannedUntil[url]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.bannedUntil, url)
+		delete(b.failures, url)
+		return false
+	}
+	return true
+}
+
+// webseedConn is a lightweight stand-in for conn.Conn used to track an
+// in-flight HTTP range request against a webseed URL. It exists so that
+// webseed traffic can be folded into the same idle/TTL bookkeeping as peer
+// conns without requiring a real bittorrent handshake.
+type webseedConn struct {
+	url        string
+	infoHash   torlib.InfoHash
+	createdAt  time.Time
+	lastActive time.Time
+}
+
+func newWebseedConn(url string, infoHash torlib.InfoHash, now time.Time) *webseedConn {
+	return &webseedConn{
+		url:        url,
+		infoHash:   infoHash,
+		createdAt:  now,
+		lastActive: now,
+	}
+}
+
+// webseedClient issues piece-range requests against a torrent's configured
+// HTTP(S) webseed URLs and reports the results back into the event loop. It
+// runs a fixed-size pool of worker goroutines so that a torrent with a huge
+// number of missing pieces (the exact scenario the roaring-bitmap piece
+// status exists to handle cheaply) cannot spin up one HTTP request goroutine
+// per piece per tick.
+type webseedClient struct {
+	httpClient *http.Client
+	jobs       chan func()
+}
+
+func newWebseedClient(numWorkers int, timeout time.Duration) *webseedClient {
+	if numWorkers <= 0 {
+		numWorkers = 1
+	}
+	c := &webseedClient{
+		httpClient: &http.Client{Timeout: timeout},
+		// Buffered a few deep per worker so a burst of ticks doesn't
+		// immediately start dropping jobs, without growing unbounded.
+		jobs: make(chan func(), numWorkers*4),
+	}
+	for i := 0; i < numWorkers; i++ {
+		go c.worker()
+	}
+	return c
+}
+
+func (c *webseedClient) worker() {
+	for job := range c.jobs {
+		job()
+	}
+}
+
+// trySubmit enqueues job onto the worker pool without blocking. Returns
+// false if every worker is busy and the queue is full, in which case the
+// caller should simply try again on the next tick rather than blocking the
+// single-threaded event loop.
+func (c *webseedClient) trySubmit(job func()) bool {
+	select {
+	case c.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// fetchPiece downloads the byte range [start, end) of url and returns the
+// raw bytes, or an error if the server does not honor the range request.
+func (c *webseedClient) fetchPiece(url string, start, end int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %s", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %s", err)
+	}
+	if int64(len(data)) != end-start {
+		return nil, fmt.Errorf("range not honored: got %d bytes, want %d", len(data), end-start)
+	}
+	return data, nil
+}
+
+// startWebseedTicker sends a webseedTickEvent into loop every interval,
+// until stopc is closed. The Scheduler starts this alongside its other
+// periodic tickers (announce, preemption, blacklist cleanup, stats) when it
+// starts its event loop, so that webseedTickEvent actually fires.
+func startWebseedTicker(loop eventSender, interval time.Duration, stopc <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			loop.Send(webseedTickEvent{})
+		case <-stopc:
+			return
+		}
+	}
+}
+
+// webseedTickEvent occurs periodically to pull missing pieces from any
+// configured webseed URLs when peers are scarce or slow.
+type webseedTickEvent struct{}
+
+// Apply walks s.torrentControls and, for each incomplete dispatcher with
+// webseed URLs configured, schedules fetches for a batch of missing pieces
+// via the worker pool. Fetches run asynchronously and feed results back into
+// the event loop as webseedPieceReceivedEvents.
+func (e webseedTickEvent) Apply(s *Scheduler) {
+	s.log().Debug("Applying webseed tick event")
+
+	for infoHash, ctrl := range s.torrentControls {
+		if ctrl.Complete {
+			continue
+		}
+		urls := ctrl.Dispatcher.Torrent.WebseedURLs()
+		if len(urls) == 0 {
+			continue
+		}
+		missing := ctrl.Dispatcher.Torrent.MissingPieces()
+		if len(missing) == 0 {
+			continue
+		}
+		for _, pieceIndex := range missing {
+			url := urls[pieceIndex%len(urls)]
+			if s.webseedFailures.blocked(url) {
+				continue
+			}
+			// Register this URL's webseedConn, if not already tracked, so it is swept by
+			// the same idle/TTL bookkeeping preemptionTickEvent applies to
+			// peer conns, and capture the piece's byte range here on the
+			// event loop thread -- the job below runs on a worker-pool
+			// goroutine and must not touch s.torrentControls itself, since
+			// that map is only safe to read/write from the event loop.
+			s.connState.EnsureWebseedConn(url, infoHash, s.clock.Now())
+			infoHash := infoHash
+			pieceIndex := pieceIndex
+			start, end := ctrl.Dispatcher.Torrent.PieceByteRange(pieceIndex)
+			submitted := s.webseeds.trySubmit(func() {
+				s.fetchWebseedPiece(url, infoHash, pieceIndex, start, end)
+			})
+			if !submitted {
+				// Worker pool is saturated; the piece is still missing so
+				// it will be picked up again on the next tick.
+				break
+			}
+		}
+	}
+}
+
+// fetchWebseedPiece issues a single ranged HTTP request for pieceIndex of
+// infoHash against the byte range [start, end) of url, and sends the result
+// back into the event loop. Runs on a worker-pool goroutine, not the event
+// loop, so start/end are passed in by the caller rather than re-derived from
+// s.torrentControls here.
+func (s *Scheduler) fetchWebseedPiece(url string, infoHash torlib.InfoHash, pieceIndex int, start, end int64) {
+	data, err := s.webseeds.fetchPiece(url, start, end)
+	if err != nil {
+		s.log("hash", infoHash, "piece", pieceIndex, "url", url).Infof(
+			"Webseed fetch failed, backing off: %s", err)
+		s.webseedFailures.record(url)
+		return
+	}
+	s.connState.TouchWebseedConn(url, infoHash, s.clock.Now())
+	s.eventLoop.Send(webseedPieceReceivedEvent{infoHash, pieceIndex, url, data})
+}
+
+// webseedPieceReceivedEvent occurs when a piece has been fully downloaded
+// from a webseed URL.
+type webseedPieceReceivedEvent struct {
+	infoHash   torlib.InfoHash
+	pieceIndex int
+	url        string
+	data       []byte
+}
+
+// Apply feeds the downloaded piece into the dispatcher as if it had arrived
+// from a peer conn, integrating with the same completedDispatcherEvent path
+// used by real peer traffic.
+func (e webseedPieceReceivedEvent) Apply(s *Scheduler) {
+	s.log("hash", e.infoHash, "piece", e.pieceIndex, "url", e.url).Debug(
+		"Applying webseed piece received event")
+
+	ctrl, ok := s.torrentControls[e.infoHash]
+	if !ok {
+		s.log("hash", e.infoHash).Info("Dispatcher closed before webseed piece arrived")
+		return
+	}
+	if err := ctrl.Dispatcher.WritePiece(storage.PeerIDWebseed, e.pieceIndex, e.data); err != nil {
+		s.log("hash", e.infoHash, "piece", e.pieceIndex).Infof(
+			"Error writing webseed piece, will retry: %s", err)
+		s.webseedFailures.record(e.url)
+		return
+	}
+	s.webseedFailures.reset(e.url)
+	// Accumulated here rather than pushed to stats directly: emitStatsEvent
+	// periodically reports this as a per-torrent gauge, so a torrent with
+	// no webseed activity this tick doesn't get its last value clobbered by
+	// an unrelated torrent's single Gauge.Update.
+	ctrl.WebseedBytesReceived += int64(len(e.data))
+
+	if ctrl.Dispatcher.Complete() {
+		s.eventLoop.Send(completedDispatcherEvent{ctrl.Dispatcher})
+	}
+}